@@ -0,0 +1,25 @@
+// +build !windows
+
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package doctor
+
+import (
+	"os"
+	"syscall"
+)
+
+// preserveOwnership re-applies the uid/gid that prevInfo (the file's state
+// before it was rewritten) had.  This is best-effort: os.Chown only
+// succeeds if the process has permission (typically, it's running as that
+// uid or as root), and a failure here is not treated as fatal.
+func preserveOwnership(path string, prevInfo os.FileInfo) error {
+	stat, ok := prevInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	os.Chown(path, int(stat.Uid), int(stat.Gid))
+	return nil
+}
@@ -6,17 +6,31 @@ package doctor
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 /* -=-=- File System Interface -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
 
+// FileIdentity identifies the content of a file at a point in time, cheaply
+// enough to use as a cache key.  Hash is what actually distinguishes content
+// (two reads of unchanged content always produce the same Hash); Version is
+// a monotonically increasing counter that lets a FileSystem implementation
+// tell a caller "definitely unchanged" without recomputing Hash at all.
+type FileIdentity struct {
+	URI     string
+	Hash    [32]byte
+	Version int64
+}
+
 type FileSystem interface {
 	// ReadDir returns a slice of os.FileInfo, sorted by Name,
 	// describing the content of the named directory.
@@ -29,6 +43,12 @@ type FileSystem interface {
 	// permissions.
 	CreateFile(path, contents string) error
 
+	// WriteFile writes contents to path.  If path already exists, its
+	// current permissions (and, on POSIX, ownership) are preserved rather
+	// than being reset to the process's default/umask-derived mode; if it
+	// doesn't, WriteFile behaves like CreateFile.
+	WriteFile(path, contents string) error
+
 	// Rename changes the name of a file or directory.  newName should be a
 	// bare name, not including a directory prefix; the existing file will
 	// be renamed within its existing parent directory.
@@ -36,14 +56,31 @@ type FileSystem interface {
 
 	// Remove deletes a file or an empty directory.
 	Remove(path string) error
+
+	// Identity returns path's current FileIdentity, computing and caching
+	// its content hash as cheaply as the implementation allows.
+	Identity(path string) (FileIdentity, error)
 }
 
 /* -=-=- Local File System -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
 
-type LocalFileSystem struct{}
+type LocalFileSystem struct {
+	mu    sync.Mutex
+	cache map[string]localIdentityCacheEntry
+}
+
+// localIdentityCacheEntry memoizes the SHA-256 hash computed for a path the
+// last time Identity was called, along with the (mtime, size) pair that was
+// true of the file at that time; a changed mtime or size invalidates it.
+type localIdentityCacheEntry struct {
+	mtime   int64
+	size    int64
+	version int64
+	hash    [32]byte
+}
 
 func NewLocalFileSystem() *LocalFileSystem {
-	return &LocalFileSystem{}
+	return &LocalFileSystem{cache: map[string]localIdentityCacheEntry{}}
 }
 
 func (fs *LocalFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
@@ -76,6 +113,30 @@ func (fs *LocalFileSystem) CreateFile(path, contents string) error {
 	return nil
 }
 
+func (fs *LocalFileSystem) WriteFile(path, contents string) error {
+	prevInfo, statErr := os.Stat(path)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(file, contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if statErr != nil {
+		return nil // path didn't previously exist; nothing to preserve
+	}
+	if err := os.Chmod(path, prevInfo.Mode()&os.ModePerm); err != nil {
+		return err
+	}
+	return preserveOwnership(path, prevInfo)
+}
+
 func (fs *LocalFileSystem) Rename(oldPath, newName string) error {
 	if !isBareFilename(newName) {
 		return fmt.Errorf("newName must be a bare filename: %s",
@@ -89,67 +150,148 @@ func (fs *LocalFileSystem) Remove(path string) error {
 	return os.Remove(path)
 }
 
+func (fs *LocalFileSystem) Identity(path string) (FileIdentity, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+	mtime, size := info.ModTime().UnixNano(), info.Size()
+
+	fs.mu.Lock()
+	cached, ok := fs.cache[path]
+	fs.mu.Unlock()
+	if ok && cached.mtime == mtime && cached.size == size {
+		return FileIdentity{URI: path, Hash: cached.hash, Version: cached.version}, nil
+	}
+
+	reader, err := fs.OpenFile(path)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+	hash := sha256.Sum256(contents)
+
+	fs.mu.Lock()
+	version := fs.cache[path].version + 1
+	fs.cache[path] = localIdentityCacheEntry{mtime: mtime, size: size, version: version, hash: hash}
+	fs.mu.Unlock()
+
+	return FileIdentity{URI: path, Hash: hash, Version: version}, nil
+}
+
 /* -=-=- Edited File System -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
 
+// EditedFileSystem layers an in-memory overlay (for previewing whole-
+// refactoring changes that add or move files) on top of disk, and applies
+// a pending set of edits to whatever the overlay/disk combination produces
+// for OpenFile.  It is a CopyOnWriteFileSystem{Base: LocalFileSystem,
+// Overlay: VirtualFileSystem} plus that edit-application decorator, so
+// CreateFile/Rename/Remove all just work instead of panicking.
 type EditedFileSystem struct {
-	LocalFileSystem
+	CopyOnWriteFileSystem
 	Edits map[string]EditSet
+
+	// identityHash/identityVersion track, per path, the post-edit hash last
+	// observed by Identity and the version assigned to it, so Version bumps
+	// whenever the edited content actually changes (e.g. Edits is updated).
+	identityHash    map[string][32]byte
+	identityVersion map[string]int64
 }
 
 func NewEditedFileSystem(edits map[string]EditSet) *EditedFileSystem {
-	return &EditedFileSystem{Edits: edits}
+	return &EditedFileSystem{
+		CopyOnWriteFileSystem: *NewCopyOnWriteFileSystem(
+			NewLocalFileSystem(), NewVirtualFileSystem()),
+		Edits:           edits,
+		identityHash:    map[string][32]byte{},
+		identityVersion: map[string]int64{},
+	}
 }
 
 func (fs *EditedFileSystem) OpenFile(path string) (io.ReadCloser, error) {
-	localReader, err := fs.LocalFileSystem.OpenFile(path)
+	reader, err := fs.CopyOnWriteFileSystem.OpenFile(path)
 	editSet, ok := fs.Edits[path]
 	if err != nil || !ok {
-		return localReader, err
+		return reader, err
 	}
-	contents, err := ApplyToReader(editSet, localReader)
+	contents, err := ApplyToReader(editSet, reader)
 	if err != nil {
 		return nil, err
 	}
 	return ioutil.NopCloser(bytes.NewReader(contents)), nil
 }
 
-func (fs *EditedFileSystem) CreateFile(path, contents string) error {
-	panic("CreateFile unsupported")
-}
-
-func (fs *EditedFileSystem) CreateDirectory(path string) error {
-	panic("CreateDirectory unsupported")
-}
-
-func (fs *EditedFileSystem) Rename(path, newName string) error {
-	panic("Rename unsupported")
-}
+// Identity hashes the post-edit content (i.e. what OpenFile would return),
+// not the on-disk/overlay bytes, since those are what a caller caching
+// parsed ASTs or type-check results actually cares about.
+func (fs *EditedFileSystem) Identity(path string) (FileIdentity, error) {
+	reader, err := fs.OpenFile(path)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+	hash := sha256.Sum256(contents)
 
-func (fs *EditedFileSystem) Remove(path string) error {
-	panic("Remove unsupported")
+	if fs.identityHash[path] != hash {
+		fs.identityVersion[path]++
+		fs.identityHash[path] = hash
+	}
+	return FileIdentity{URI: path, Hash: hash, Version: fs.identityVersion[path]}, nil
 }
 
 /* -=-=- Virtual File System -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
 
 type VirtualFileSystem struct {
 	files map[string]string
+
+	// identityHash/identityVersion track, per path, the hash last observed
+	// by Identity and the version assigned to it, so Version only bumps
+	// when the in-memory content actually changes.
+	identityHash    map[string][32]byte
+	identityVersion map[string]int64
 }
 
 func NewVirtualFileSystem() *VirtualFileSystem {
 	return &VirtualFileSystem{files: map[string]string{}}
 }
 
+// isInGoRoot reports whether path is under $GOROOT, so VirtualFileSystem
+// knows to serve it from real disk instead of its in-memory files map.  When
+// GOROOT isn't set as an actual environment variable (common: the go tool
+// resolves it internally even when unset), every path has "" as a prefix,
+// so an empty GOROOT must mean "nothing is in GOROOT," not "everything is."
 func isInGoRoot(path string) bool {
-	return strings.HasPrefix(path, os.Getenv("GOROOT"))
+	goroot := os.Getenv("GOROOT")
+	return goroot != "" && strings.HasPrefix(path, goroot)
 }
 
-func (fs *VirtualFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
-	if isInGoRoot(path) {
-		return ioutil.ReadDir(path)
-	} else {
-		panic("NOT YET SUPPORTED: READDIR " + path)
-		return []os.FileInfo{}, nil
+func (fs *VirtualFileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	if isInGoRoot(dir) {
+		return ioutil.ReadDir(dir)
 	}
+
+	var result []os.FileInfo
+	for p, contents := range fs.files {
+		if path.Dir(p) != dir {
+			continue
+		}
+		result = append(result, virtualFileInfo{
+			name: path.Base(p),
+			size: int64(len(contents)),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
 }
 
 func (fs *VirtualFileSystem) OpenFile(path string) (io.ReadCloser, error) {
@@ -159,17 +301,28 @@ func (fs *VirtualFileSystem) OpenFile(path string) (io.ReadCloser, error) {
 			return nil, err
 		}
 		return f, nil
-	} else {
-		_, fname := filepath.Split(path)
-		contents, ok := fs.files[fname]
-		if !ok {
-			return nil,
-				fmt.Errorf("Virtual file not found: %s", fname)
-		}
-		return ioutil.NopCloser(strings.NewReader(contents)), nil
 	}
+	contents, ok := fs.files[path]
+	if !ok {
+		return nil, fmt.Errorf("Virtual file not found: %s", path)
+	}
+	return ioutil.NopCloser(strings.NewReader(contents)), nil
+}
+
+// virtualFileInfo is a minimal os.FileInfo for entries synthesized by
+// VirtualFileSystem.ReadDir; virtual files have no real mode or mtime.
+type virtualFileInfo struct {
+	name string
+	size int64
 }
 
+func (fi virtualFileInfo) Name() string       { return fi.name }
+func (fi virtualFileInfo) Size() int64        { return fi.size }
+func (fi virtualFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi virtualFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi virtualFileInfo) IsDir() bool        { return false }
+func (fi virtualFileInfo) Sys() interface{}   { return nil }
+
 func (fs *VirtualFileSystem) CreateFile(path, contents string) error {
 	if _, ok := fs.files[path]; ok {
 		return fmt.Errorf("File already exists: %s", path)
@@ -181,6 +334,14 @@ func (fs *VirtualFileSystem) CreateFile(path, contents string) error {
 	return nil
 }
 
+func (fs *VirtualFileSystem) WriteFile(path, contents string) error {
+	if fs.files == nil {
+		fs.files = map[string]string{}
+	}
+	fs.files[path] = contents
+	return nil
+}
+
 func (fs *VirtualFileSystem) Rename(path, newName string) error {
 	if _, ok := fs.files[path]; !ok {
 		return fmt.Errorf("File does not exist: %s", path)
@@ -201,10 +362,313 @@ func (fs *VirtualFileSystem) Remove(path string) error {
 	return nil
 }
 
+func (fs *VirtualFileSystem) Identity(path string) (FileIdentity, error) {
+	contents, ok := fs.files[path]
+	if !ok {
+		return FileIdentity{}, fmt.Errorf("Virtual file not found: %s", path)
+	}
+	hash := sha256.Sum256([]byte(contents))
+
+	if fs.identityHash == nil {
+		fs.identityHash = map[string][32]byte{}
+		fs.identityVersion = map[string]int64{}
+	}
+	if fs.identityHash[path] != hash {
+		fs.identityVersion[path]++
+		fs.identityHash[path] = hash
+	}
+	return FileIdentity{URI: path, Hash: hash, Version: fs.identityVersion[path]}, nil
+}
+
+/* -=-=- Copy-on-Write File System -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
+
+// CopyOnWriteFileSystem layers a mutable Overlay on top of a read-mostly
+// Base, in the spirit of afero's overlay filesystems: every mutation
+// (CreateFile, Rename, Remove) lands in Overlay, reads prefer Overlay and
+// fall back to Base, and removing a Base-only path is recorded as a
+// tombstone so later reads see it as gone without Base ever being touched.
+type CopyOnWriteFileSystem struct {
+	Base    FileSystem
+	Overlay FileSystem
+
+	mu         sync.Mutex
+	tombstoned map[string]bool
+}
+
+func NewCopyOnWriteFileSystem(base, overlay FileSystem) *CopyOnWriteFileSystem {
+	return &CopyOnWriteFileSystem{
+		Base:       base,
+		Overlay:    overlay,
+		tombstoned: map[string]bool{},
+	}
+}
+
+func (fs *CopyOnWriteFileSystem) isTombstoned(path string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.tombstoned[path]
+}
+
+func (fs *CopyOnWriteFileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	overlayEntries, overlayErr := fs.Overlay.ReadDir(dir)
+	baseEntries, baseErr := fs.Base.ReadDir(dir)
+	if overlayErr != nil && baseErr != nil {
+		return nil, baseErr
+	}
+
+	merged := map[string]os.FileInfo{}
+	if baseErr == nil {
+		for _, info := range baseEntries {
+			merged[info.Name()] = info
+		}
+	}
+	if overlayErr == nil {
+		for _, info := range overlayEntries {
+			merged[info.Name()] = info
+		}
+	}
+
+	fs.mu.Lock()
+	for tombstone := range fs.tombstoned {
+		if path.Dir(tombstone) == dir {
+			delete(merged, path.Base(tombstone))
+		}
+	}
+	fs.mu.Unlock()
+
+	result := make([]os.FileInfo, 0, len(merged))
+	for _, info := range merged {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+func (fs *CopyOnWriteFileSystem) OpenFile(path string) (io.ReadCloser, error) {
+	if fs.isTombstoned(path) {
+		return nil, fmt.Errorf("Path does not exist: %s", path)
+	}
+	if reader, err := fs.Overlay.OpenFile(path); err == nil {
+		return reader, nil
+	}
+	return fs.Base.OpenFile(path)
+}
+
+func (fs *CopyOnWriteFileSystem) CreateFile(path, contents string) error {
+	if _, err := fs.OpenFile(path); err == nil {
+		return fmt.Errorf("Path already exists: %s", path)
+	}
+	fs.mu.Lock()
+	delete(fs.tombstoned, path)
+	fs.mu.Unlock()
+	return fs.Overlay.CreateFile(path, contents)
+}
+
+func (fs *CopyOnWriteFileSystem) WriteFile(path, contents string) error {
+	fs.mu.Lock()
+	delete(fs.tombstoned, path)
+	fs.mu.Unlock()
+	return fs.Overlay.WriteFile(path, contents)
+}
+
+func (fs *CopyOnWriteFileSystem) Rename(oldPath, newName string) error {
+	if !isBareFilename(newName) {
+		return fmt.Errorf("newName must be a bare filename: %s", newName)
+	}
+
+	reader, err := fs.OpenFile(oldPath)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	newPath := path.Join(path.Dir(oldPath), newName)
+	if err := fs.Overlay.CreateFile(newPath, string(contents)); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	delete(fs.tombstoned, newPath)
+	fs.mu.Unlock()
+	return fs.Remove(oldPath)
+}
+
+func (fs *CopyOnWriteFileSystem) Remove(path string) error {
+	if _, err := fs.OpenFile(path); err != nil {
+		return err
+	}
+	// The overlay copy (if there was one created/renamed on top of Base) is
+	// no longer reachable anyway, but drop it too so Overlay doesn't grow
+	// unboundedly; it's fine if it was never there.
+	fs.Overlay.Remove(path)
+
+	fs.mu.Lock()
+	fs.tombstoned[path] = true
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *CopyOnWriteFileSystem) Identity(path string) (FileIdentity, error) {
+	if fs.isTombstoned(path) {
+		return FileIdentity{}, fmt.Errorf("Path does not exist: %s", path)
+	}
+	if identity, err := fs.Overlay.Identity(path); err == nil {
+		return identity, nil
+	}
+	return fs.Base.Identity(path)
+}
+
+/* -=-=- Cache-on-Read File System -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
+
+// CacheOnReadFileSystem memoizes OpenFile bytes and ReadDir results for
+// whatever FileSystem it wraps, keyed by the path's on-disk mtime.  Paths
+// that aren't backed by a real file (e.g. one that exists only in a
+// VirtualFileSystem overlay) have no mtime to key on and are simply never
+// cached.
+type CacheOnReadFileSystem struct {
+	FileSystem
+
+	mu    sync.Mutex
+	files map[string]fileCacheEntry
+	dirs  map[string]dirCacheEntry
+}
+
+type fileCacheEntry struct {
+	mtime    int64
+	contents []byte
+}
+
+type dirCacheEntry struct {
+	mtime   int64
+	entries []os.FileInfo
+}
+
+func NewCacheOnReadFileSystem(fs FileSystem) *CacheOnReadFileSystem {
+	return &CacheOnReadFileSystem{
+		FileSystem: fs,
+		files:      map[string]fileCacheEntry{},
+		dirs:       map[string]dirCacheEntry{},
+	}
+}
+
+// statMtime returns path's on-disk mtime, or ok=false if it isn't backed by
+// a real file, in which case the caller must not cache it.
+func statMtime(path string) (mtime int64, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	return info.ModTime().UnixNano(), true
+}
+
+func (fs *CacheOnReadFileSystem) OpenFile(path string) (io.ReadCloser, error) {
+	mtime, cacheable := statMtime(path)
+	if cacheable {
+		fs.mu.Lock()
+		cached, ok := fs.files[path]
+		fs.mu.Unlock()
+		if ok && cached.mtime == mtime {
+			return ioutil.NopCloser(bytes.NewReader(cached.contents)), nil
+		}
+	}
+
+	reader, err := fs.FileSystem.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		fs.mu.Lock()
+		fs.files[path] = fileCacheEntry{mtime: mtime, contents: contents}
+		fs.mu.Unlock()
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (fs *CacheOnReadFileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	mtime, cacheable := statMtime(dir)
+	if cacheable {
+		fs.mu.Lock()
+		cached, ok := fs.dirs[dir]
+		fs.mu.Unlock()
+		if ok && cached.mtime == mtime {
+			return cached.entries, nil
+		}
+	}
+
+	entries, err := fs.FileSystem.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		fs.mu.Lock()
+		fs.dirs[dir] = dirCacheEntry{mtime: mtime, entries: entries}
+		fs.mu.Unlock()
+	}
+	return entries, nil
+}
+
+func (fs *CacheOnReadFileSystem) CreateFile(path, contents string) error {
+	err := fs.FileSystem.CreateFile(path, contents)
+	if err == nil {
+		fs.invalidate(path)
+	}
+	return err
+}
+
+func (fs *CacheOnReadFileSystem) WriteFile(path, contents string) error {
+	err := fs.FileSystem.WriteFile(path, contents)
+	if err == nil {
+		fs.invalidate(path)
+	}
+	return err
+}
+
+func (fs *CacheOnReadFileSystem) Rename(oldPath, newName string) error {
+	err := fs.FileSystem.Rename(oldPath, newName)
+	if err == nil {
+		fs.invalidate(oldPath)
+		fs.invalidate(path.Join(path.Dir(oldPath), newName))
+	}
+	return err
+}
+
+func (fs *CacheOnReadFileSystem) Remove(path string) error {
+	err := fs.FileSystem.Remove(path)
+	if err == nil {
+		fs.invalidate(path)
+	}
+	return err
+}
+
+func (fs *CacheOnReadFileSystem) invalidate(changedPath string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, changedPath)
+	delete(fs.dirs, changedPath)
+	delete(fs.dirs, path.Dir(changedPath))
+}
+
 /* -=-=- File System Changes -=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=-=- */
 
 type FileSystemChange interface {
 	ExecuteUsing(FileSystem) error
+
+	// Inverse returns the change that undoes this one, capturing whatever
+	// state (e.g. a file's current contents) it needs from fs before this
+	// change is actually applied.
+	Inverse(FileSystem) (FileSystemChange, error)
 }
 
 type fsCreateFile struct {
@@ -212,9 +676,34 @@ type fsCreateFile struct {
 }
 
 func (chg *fsCreateFile) ExecuteUsing(fs FileSystem) error {
+	if _, err := fs.OpenFile(chg.path); err == nil {
+		// The path already has content (e.g. a refactoring rewriting a file
+		// via delete-then-recreate); overwrite it through WriteFile so its
+		// mode/ownership survive instead of reverting to CreateFile's
+		// umask-derived default.
+		return fs.WriteFile(chg.path, chg.contents)
+	}
 	return fs.CreateFile(chg.path, chg.contents)
 }
 
+func (chg *fsCreateFile) Inverse(fs FileSystem) (FileSystemChange, error) {
+	reader, err := fs.OpenFile(chg.path)
+	if err != nil {
+		// Nothing there yet, so this is a genuine create; undoing it means
+		// removing what gets created.
+		return &fsRemove{path: chg.path}, nil
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// The path already exists, so ExecuteUsing will overwrite it via
+	// WriteFile; undoing that means restoring what was there before, the
+	// same way.
+	return &fsCreateFile{path: chg.path, contents: string(contents)}, nil
+}
+
 type fsRemove struct {
 	path string
 }
@@ -223,6 +712,19 @@ func (chg *fsRemove) ExecuteUsing(fs FileSystem) error {
 	return fs.Remove(chg.path)
 }
 
+func (chg *fsRemove) Inverse(fs FileSystem) (FileSystemChange, error) {
+	reader, err := fs.OpenFile(chg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &fsCreateFile{path: chg.path, contents: string(contents)}, nil
+}
+
 type fsRename struct {
 	path, newName string
 }
@@ -231,18 +733,112 @@ func (chg *fsRename) ExecuteUsing(fs FileSystem) error {
 	return fs.Rename(chg.path, chg.newName)
 }
 
+func (chg *fsRename) Inverse(fs FileSystem) (FileSystemChange, error) {
+	newPath := path.Join(path.Dir(chg.path), chg.newName)
+	return &fsRename{path: newPath, newName: path.Base(chg.path)}, nil
+}
+
+// Execute applies changes to fs one at a time: each change is validated and
+// asked for its Inverse against fs's *current* state -- which already
+// reflects every earlier change in this same batch -- immediately before it
+// is applied.  That lets a batch express a dependent chain (rename A to B
+// then B to C, or remove A and rename B into the name A just freed) the same
+// way applying the changes one by one would; validating the whole batch
+// up front against fs's pristine pre-batch state can't allow that, since
+// each later change's precondition only becomes true once the earlier ones
+// have actually run.  If a change fails to validate, snapshot, or apply, the
+// inverses of the changes already committed are run in reverse to roll the
+// filesystem back.
 func Execute(fs FileSystem, changes []FileSystemChange) error {
-	// TODO: the changes should be executed atomically (all-or-nothing),
-	// but currently it can fail in the middle of execution
-	for _, chg := range changes {
+	inverses := make([]FileSystemChange, 0, len(changes))
+	for i, chg := range changes {
+		if err := validateChange(fs, chg); err != nil {
+			return withRollback(fs, inverses,
+				fmt.Errorf("change %d of %d is invalid: %s", i+1, len(changes), err))
+		}
+		inverse, err := chg.Inverse(fs)
+		if err != nil {
+			return withRollback(fs, inverses,
+				fmt.Errorf("change %d of %d could not be prepared: %s", i+1, len(changes), err))
+		}
 		if err := chg.ExecuteUsing(fs); err != nil {
+			return withRollback(fs, inverses,
+				fmt.Errorf("change %d of %d failed: %s", i+1, len(changes), err))
+		}
+		inverses = append(inverses, inverse)
+	}
+	return nil
+}
+
+// withRollback runs the inverses of already-applied changes in reverse,
+// best-effort, before returning err -- folding in any rollback failures so
+// neither the original problem nor an undo problem gets silently dropped.
+func withRollback(fs FileSystem, inverses []FileSystemChange, err error) error {
+	var rollbackErrs []string
+	for i := len(inverses) - 1; i >= 0; i-- {
+		if rbErr := inverses[i].ExecuteUsing(fs); rbErr != nil {
+			rollbackErrs = append(rollbackErrs,
+				fmt.Sprintf("could not undo change %d: %s", i+1, rbErr))
+		}
+	}
+	if len(rollbackErrs) > 0 {
+		return fmt.Errorf("%s (rollback also failed: %s)", err, strings.Join(rollbackErrs, "; "))
+	}
+	return err
+}
+
+// validateChange checks chg's precondition against fs's current state --
+// that a fsRename/fsRemove's source exists, and that a fsRename's target
+// doesn't already exist (a fsCreateFile onto an existing path is a valid
+// implicit overwrite, so it has no such check).
+func validateChange(fs FileSystem, chg FileSystemChange) error {
+	switch c := chg.(type) {
+	case *fsCreateFile:
+		// ExecuteUsing overwrites a pre-existing path (preserving its
+		// mode/ownership) instead of failing, and Inverse snapshots its
+		// prior contents to restore on rollback.
+		if err := checkDirWritable(path.Dir(c.path)); err != nil {
+			return err
+		}
+
+	case *fsRename:
+		if _, err := fs.OpenFile(c.path); err != nil {
+			return fmt.Errorf("source does not exist: %s", c.path)
+		}
+		newPath := path.Join(path.Dir(c.path), c.newName)
+		if _, err := fs.OpenFile(newPath); err == nil {
+			return fmt.Errorf("rename target already exists: %s", newPath)
+		}
+		if err := checkDirWritable(path.Dir(c.path)); err != nil {
+			return err
+		}
+
+	case *fsRemove:
+		if _, err := fs.OpenFile(c.path); err != nil {
+			return fmt.Errorf("path does not exist: %s", c.path)
+		}
+		if err := checkDirWritable(path.Dir(c.path)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// checkDirWritable is a best-effort permission probe: on a real directory,
+// it requires the owner-write bit; a path with no backing os.Stat (e.g. one
+// that only exists in an in-memory overlay) is assumed writable.
+func checkDirWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		return fmt.Errorf("directory is not writable: %s", dir)
+	}
+	return nil
+}
+
 func isBareFilename(filePath string) bool {
 	dir, _ := path.Split(filePath)
 	return dir == ""
-}
\ No newline at end of file
+}
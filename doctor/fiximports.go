@@ -26,6 +26,17 @@ import (
 
 type FixImportsTransformation struct {
 	RefactoringBase
+
+	// index is the package index used to resolve unresolved identifiers to
+	// import paths.  Run sets it to the process-wide globalPackageIndex,
+	// whose lookup rewalks GOROOT/GOPATH at most once per
+	// packageIndexRefreshInterval rather than once per identifier.
+	index *packageIndex
+
+	// localPrefixes holds the import path prefixes (from the LocalPrefix
+	// parameter) that should be grouped with the local packages rather than
+	// with third-party ones, e.g. a company's internal repo path.
+	localPrefixes []string
 }
 
 func (r *FixImportsTransformation) Name() string {
@@ -33,11 +44,18 @@ func (r *FixImportsTransformation) Name() string {
 }
 
 func (r *FixImportsTransformation) Configure(args []string) bool {
+	if len(args) > 0 {
+		for _, prefix := range strings.Split(args[0], ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				r.localPrefixes = append(r.localPrefixes, prefix)
+			}
+		}
+	}
 	return true
 }
 
 func (r *FixImportsTransformation) GetParams() []string {
-	return []string{}
+	return []string{"LocalPrefix"}
 }
 
 func (r *FixImportsTransformation) Run() {
@@ -50,6 +68,8 @@ func (r *FixImportsTransformation) Run() {
 
 	//ast.Print(r.importer.Fset, r.file)
 
+	r.index = globalPackageIndex
+
 	imports := r.findUsedImports()
 
 	for _, ident := range r.file.Unresolved {
@@ -130,29 +150,79 @@ func (r *FixImportsTransformation) isIdentInLHSOfSelectorExpr(ident *ast.Ident)
 }
 
 func (r *FixImportsTransformation) resolveSelector(ident *ast.Ident) string {
-	var candidates []string = []string{}
-	for _, pkg := range goLibraryPackages {
-		components := strings.Split(pkg, "/")
-		last := components[len(components)-1]
-		if last == ident.Name {
-			candidates = append(candidates, pkg)
-		}
+	candidates := r.index.lookup(ident.Name)
+	if len(candidates) == 0 {
+		r.log.Log(ERROR, "Unable to resolve "+ident.Name)
+		return ""
 	}
 	if len(candidates) == 1 {
-		return "\"" + candidates[0] + "\""
-	} else {
-		// TODO: Could look at what methods are invoked, etc. to
-		// attempt to resolve this
-		var message bytes.Buffer
-		message.WriteString("There are multiple packages named ")
-		message.WriteString(ident.Name)
-		message.WriteString(":\n")
-		for _, candidate := range candidates {
-			message.WriteString("    " + candidate + "\n")
+		return "\"" + candidates[0].importPath + "\""
+	}
+
+	candidates = r.disambiguateByExports(ident, candidates)
+	if len(candidates) == 1 {
+		return "\"" + candidates[0].importPath + "\""
+	}
+
+	var message bytes.Buffer
+	message.WriteString("There are multiple packages named ")
+	message.WriteString(ident.Name)
+	message.WriteString(":\n")
+	for _, candidate := range candidates {
+		message.WriteString("    " + candidate.importPath + "\n")
+	}
+	r.log.Log(ERROR, message.String())
+	return ""
+}
+
+// disambiguateByExports narrows candidates down to the packages that
+// actually export every selector used against ident in the file, e.g. given
+// foo.Bar() it discards any candidate named foo that doesn't export Bar.
+// If no candidate exports them all, candidates is returned unchanged.
+func (r *FixImportsTransformation) disambiguateByExports(ident *ast.Ident, candidates []pkgIndexEntry) []pkgIndexEntry {
+	selectors := r.collectSelectorsUsedWith(ident.Name)
+	if len(selectors) == 0 {
+		return candidates
+	}
+
+	var matches []pkgIndexEntry
+	for _, candidate := range candidates {
+		exports, err := cachedExportedNamesInDir(candidate.dir)
+		if err != nil {
+			continue
+		}
+		exportsAll := true
+		for selector := range selectors {
+			if !exports[selector] {
+				exportsAll = false
+				break
+			}
+		}
+		if exportsAll {
+			matches = append(matches, candidate)
 		}
-		r.log.Log(ERROR, message.String())
-		return ""
 	}
+	if len(matches) == 0 {
+		return candidates
+	}
+	return matches
+}
+
+// collectSelectorsUsedWith returns the set of names X.Sel where X is an
+// identifier named pkgName, e.g. {"Println", "Printf"} for pkgName "fmt".
+func (r *FixImportsTransformation) collectSelectorsUsedWith(pkgName string) map[string]bool {
+	selectors := map[string]bool{}
+	ast.Inspect(r.file, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); ok && x.Name == pkgName {
+			selectors[sel.Sel.Name] = true
+		}
+		return true
+	})
+	return selectors
 }
 
 func (r *FixImportsTransformation) fixImports(imports map[string]string) {
@@ -196,173 +266,81 @@ func (r *FixImportsTransformation) findImportStatementRange() OffsetLength {
 	return OffsetLength{startOffset, length}
 }
 
+// importGroup identifies one of the four import groups that
+// constructNewImportStatement separates with a blank line, in the order
+// they are emitted.
+type importGroup int
+
+const (
+	groupStdlib importGroup = iota
+	groupAppengine
+	groupThirdParty
+	groupLocal
+)
+
+// classify assigns a (possibly still-quoted) import path to a group: a
+// match against localPrefixes wins first, then the appengine package,
+// then any path whose first component contains a dot (third-party),
+// and otherwise stdlib.
+func (r *FixImportsTransformation) classify(path string) importGroup {
+	path = strings.Trim(path, "\"")
+	for _, prefix := range r.localPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return groupLocal
+		}
+	}
+
+	first := path
+	if i := strings.Index(path, "/"); i >= 0 {
+		first = path[:i]
+	}
+	if first == "appengine" {
+		return groupAppengine
+	}
+	if strings.Contains(first, ".") {
+		return groupThirdParty
+	}
+	return groupStdlib
+}
+
 func (r *FixImportsTransformation) constructNewImportStatement(importSet map[string]string) string {
-	// Construct the lines of the new import statement from importSet
-	imports := []string{}
+	// Bucket each import line into its group, preserving named, blank
+	// (_ "path"), and dot (. "path") import forms.
+	groups := make([][]string, groupLocal+1)
 	for path, name := range importSet {
-		var thisImport string
+		var line string
 		if name == "" {
-			thisImport = path
+			line = path
 		} else {
-			thisImport = name + " " + path
+			line = name + " " + path
 		}
-		imports = append(imports, thisImport)
+		group := r.classify(path)
+		groups[group] = append(groups[group], line)
+	}
+	for _, lines := range groups {
+		sort.Strings(lines)
 	}
-	sort.Strings(imports)
 
-	// Construct the import statement
+	// Construct the import statement, separating non-empty groups with a
+	// single blank line, in stdlib / appengine / third-party / local order.
 	var buffer bytes.Buffer
 	buffer.WriteString("import (\n")
-	for _, line := range imports {
-		buffer.WriteString("\t")
-		buffer.WriteString(line)
-		buffer.WriteString("\n")
+	wroteGroup := false
+	for _, lines := range groups {
+		if len(lines) == 0 {
+			continue
+		}
+		if wroteGroup {
+			buffer.WriteString("\n")
+		}
+		for _, line := range lines {
+			buffer.WriteString("\t")
+			buffer.WriteString(line)
+			buffer.WriteString("\n")
+		}
+		wroteGroup = true
 	}
 	buffer.WriteString(")\n")
 	return buffer.String()
 }
 
-var goLibraryPackages []string = []string{
-	"archive",
-	"archive/tar",
-	"archive/zip",
-	"bufio",
-	"builtin",
-	"bytes",
-	"compress",
-	"compress/bzip2",
-	"compress/flate",
-	"compress/gzip",
-	"compress/lzw",
-	"compress/zlib",
-	"container",
-	"container/heap",
-	"container/list",
-	"container/ring",
-	"crypto",
-	"crypto/aes",
-	"crypto/cipher",
-	"crypto/des",
-	"crypto/dsa",
-	"crypto/ecdsa",
-	"crypto/elliptic",
-	"crypto/hmac",
-	"crypto/md5",
-	"crypto/rand",
-	"crypto/rc4",
-	"crypto/rsa",
-	"crypto/sha1",
-	"crypto/sha256",
-	"crypto/sha512",
-	"crypto/subtle",
-	"crypto/tls",
-	"crypto/x509",
-	"crypto/x509/pkix",
-	"database",
-	"database/sql",
-	"database/sql/driver",
-	"debug",
-	"debug/dwarf",
-	"debug/elf",
-	"debug/gosym",
-	"debug/macho",
-	"debug/pe",
-	"encoding",
-	"encoding/ascii85",
-	"encoding/asn1",
-	"encoding/base32",
-	"encoding/base64",
-	"encoding/binary",
-	"encoding/csv",
-	"encoding/gob",
-	"encoding/hex",
-	"encoding/json",
-	"encoding/pem",
-	"encoding/xml",
-	"errors",
-	"expvar",
-	"flag",
-	"fmt",
-	"go",
-	"go/ast",
-	"go/build",
-	"go/doc",
-	"go/format",
-	"go/parser",
-	"go/printer",
-	"go/scanner",
-	"go/token",
-	"hash",
-	"hash/adler32",
-	"hash/crc32",
-	"hash/crc64",
-	"hash/fnv",
-	"html",
-	"html/template",
-	"image",
-	"image/color",
-	"image/color/palette",
-	"image/draw",
-	"image/gif",
-	"image/jpeg",
-	"image/png",
-	"index",
-	"index/suffixarray",
-	"io",
-	"io/ioutil",
-	"log",
-	"log/syslog",
-	"math",
-	"math/big",
-	"math/cmplx",
-	"math/rand",
-	"mime",
-	"mime/multipart",
-	"net",
-	"net/http",
-	"net/http/cgi",
-	"net/http/cookiejar",
-	"net/http/fcgi",
-	"net/http/httptest",
-	"net/http/httputil",
-	"net/http/pprof",
-	"net/mail",
-	"net/rpc",
-	"net/rpc/jsonrpc",
-	"net/smtp",
-	"net/textproto",
-	"net/url",
-	"os",
-	"os/exec",
-	"os/signal",
-	"os/user",
-	"path",
-	"path/filepath",
-	"reflect",
-	"regexp",
-	"regexp/syntax",
-	"runtime",
-	"runtime/cgo",
-	"runtime/debug",
-	"runtime/pprof",
-	"runtime/race",
-	"sort",
-	"strconv",
-	"strings",
-	"sync",
-	"sync/atomic",
-	"syscall",
-	"testing",
-	"testing/iotest",
-	"testing/quick",
-	"text",
-	"text/scanner",
-	"text/tabwriter",
-	"text/template",
-	"text/template/parse",
-	"time",
-	"unicode",
-	"unicode/utf16",
-	"unicode/utf8",
-	"unsafe",
-}
@@ -0,0 +1,46 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package doctor
+
+import "sync"
+
+// IdentityCache memoizes arbitrary per-file (or per-directory, keyed by a
+// FileIdentity derived from its files) data -- a parsed AST, a set of
+// exported names, anything expensive to recompute -- keyed by FileIdentity.
+// FixImportsTransformation uses one (see cachedExportedNamesInDir) to key
+// its exported-names cache on a directory's contents rather than on its
+// path, so a directory only gets re-parsed once its files actually change.
+type IdentityCache struct {
+	mu      sync.Mutex
+	entries map[string]identityCacheEntry // keyed by FileIdentity.URI
+}
+
+type identityCacheEntry struct {
+	identity FileIdentity
+	value    interface{}
+}
+
+func NewIdentityCache() *IdentityCache {
+	return &IdentityCache{entries: map[string]identityCacheEntry{}}
+}
+
+// Get returns the value Put under identity.URI, provided its Hash still
+// matches identity.Hash; a hash mismatch (or no entry at all) is a miss.
+func (c *IdentityCache) Get(identity FileIdentity) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[identity.URI]
+	if !ok || entry.identity.Hash != identity.Hash {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Put records value as the cached result for identity.URI as of identity.
+func (c *IdentityCache) Put(identity FileIdentity, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[identity.URI] = identityCacheEntry{identity: identity, value: value}
+}
@@ -0,0 +1,329 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package doctor
+
+import (
+	"crypto/sha256"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file replaces the hardcoded goLibraryPackages stdlib list with a
+// package index built by scanning GOROOT, GOPATH, and the module cache, so
+// that FixImportsTransformation can suggest third-party packages and doesn't
+// go stale every Go release.
+
+// maxConcurrentPackageIndexWalkers bounds the number of directories that are
+// read concurrently while building a packageIndex.  It limits only the
+// directory reads; scanRoot still starts one goroutine per directory, so the
+// number of goroutines is not bounded.
+const maxConcurrentPackageIndexWalkers = 32
+
+// pkgIndexEntry is a single package directory discovered while scanning.
+type pkgIndexEntry struct {
+	importPath string
+	dir        string
+}
+
+// packageIndexRefreshInterval debounces packageIndex.refresh: a lookup
+// within this long of the last refresh reuses the existing index instead of
+// re-walking every configured root, so resolving several unresolved
+// identifiers in one Run (which calls lookup once per identifier) doesn't
+// re-stat the whole GOPATH/module cache per identifier.
+const packageIndexRefreshInterval = 2 * time.Second
+
+// packageIndex maps a package's base name (the last component of its import
+// path) to every candidate import path sharing that name found under the
+// scanned roots.
+type packageIndex struct {
+	mu            sync.Mutex
+	byName        map[string][]pkgIndexEntry
+	dirMtime      map[string]int64 // absolute dir -> mtime (unix nanos) as of last scan
+	lastRefreshed time.Time
+}
+
+// globalPackageIndex is the process-wide cache, shared across
+// transformations so repeated runs don't re-walk GOROOT/GOPATH from scratch.
+var globalPackageIndex = &packageIndex{
+	byName:   map[string][]pkgIndexEntry{},
+	dirMtime: map[string]int64{},
+}
+
+// globalExportsCache memoizes exportedNamesInDir by the FileIdentity of the
+// directory's contents (see cachedExportedNamesInDir), so disambiguating
+// several same-named candidates in one Run doesn't re-parse a directory it
+// already parsed, and a later Run only re-parses the directories that
+// actually changed on disk.
+var globalExportsCache = NewIdentityCache()
+
+// diskFS reads the package index's on-disk roots (GOROOT/GOPATH/module
+// cache), never an in-memory overlay, so its per-path mtime/size memoization
+// in Identity is safe to share across every FixImportsTransformation.
+var diskFS = NewLocalFileSystem()
+
+// lookup returns every known package directory whose base name is name,
+// calling refresh first.
+func (idx *packageIndex) lookup(name string) []pkgIndexEntry {
+	idx.refresh()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return append([]pkgIndexEntry(nil), idx.byName[name]...)
+}
+
+// refresh rewalks each configured root, re-indexing only directories whose
+// mtime has changed since they were last indexed, and does nothing at all if
+// the last refresh was within packageIndexRefreshInterval.
+func (idx *packageIndex) refresh() {
+	idx.mu.Lock()
+	if !idx.lastRefreshed.IsZero() && time.Since(idx.lastRefreshed) < packageIndexRefreshInterval {
+		idx.mu.Unlock()
+		return
+	}
+	idx.lastRefreshed = time.Now()
+	idx.mu.Unlock()
+
+	for _, root := range packageIndexRoots() {
+		idx.scanRoot(root)
+	}
+}
+
+// packageIndexRoots returns $GOROOT/src, every $GOPATH/src, and (when
+// present) the module cache under $GOPATH/pkg/mod.
+func packageIndexRoots() []string {
+	var roots []string
+	if goroot := os.Getenv("GOROOT"); goroot != "" {
+		roots = append(roots, filepath.Join(goroot, "src"))
+	}
+	for _, gopath := range filepath.SplitList(os.Getenv("GOPATH")) {
+		if gopath == "" {
+			continue
+		}
+		roots = append(roots, filepath.Join(gopath, "src"))
+		modCache := filepath.Join(gopath, "pkg", "mod")
+		if info, err := os.Stat(modCache); err == nil && info.IsDir() {
+			roots = append(roots, modCache)
+		}
+	}
+	return roots
+}
+
+// scanRoot walks root with one goroutine per directory, throttling the
+// directory reads (not the goroutines) with a semaphore channel, indexing
+// every directory that contains .go files and skipping testdata, .git, and
+// directories whose base name starts with _ or ..
+func (idx *packageIndex) scanRoot(root string) {
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return
+	}
+
+	gate := make(chan struct{}, maxConcurrentPackageIndexWalkers)
+	var wg sync.WaitGroup
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		defer wg.Done()
+
+		gate <- struct{}{}
+		info, statErr := os.Stat(dir)
+		entries, readErr := ioutil.ReadDir(dir)
+		<-gate
+		if statErr != nil || readErr != nil {
+			return
+		}
+
+		// A directory's own mtime only changes when an entry is added or
+		// removed directly inside it, not when something deeper in the
+		// tree changes -- so "unchanged" only lets us skip re-indexing dir
+		// itself; it must never stop the walk from recursing into dir's
+		// subdirectories, or a change several levels down would never be
+		// found again once an ancestor's own listing had stopped changing.
+		mtime := info.ModTime().UnixNano()
+		idx.mu.Lock()
+		unchanged := idx.dirMtime[dir] == mtime
+		idx.dirMtime[dir] = mtime
+		idx.mu.Unlock()
+		if !unchanged {
+			idx.indexDir(root, dir, entries)
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || skipPackageIndexDir(entry.Name()) {
+				continue
+			}
+			wg.Add(1)
+			go walk(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	wg.Add(1)
+	go walk(root)
+	wg.Wait()
+}
+
+func skipPackageIndexDir(base string) bool {
+	return base == "testdata" || base == ".git" ||
+		strings.HasPrefix(base, "_") || strings.HasPrefix(base, ".")
+}
+
+// indexDir records dir as a package named after the last component of its
+// import path, if it contains at least one non-test .go file.
+func (idx *packageIndex) indexDir(root, dir string, entries []os.FileInfo) {
+	hasGoFile := false
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".go") &&
+			!strings.HasSuffix(entry.Name(), "_test.go") {
+			hasGoFile = true
+			break
+		}
+	}
+	if !hasGoFile {
+		return
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return
+	}
+	importPath := stripModuleVersion(filepath.ToSlash(rel))
+	name := importPath[strings.LastIndex(importPath, "/")+1:]
+
+	entry := pkgIndexEntry{importPath: importPath, dir: dir}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, existing := range idx.byName[name] {
+		if existing.importPath == importPath {
+			return
+		}
+	}
+	idx.byName[name] = append(idx.byName[name], entry)
+}
+
+// stripModuleVersion strips the "@vX.Y.Z" module-cache version suffix from
+// whichever path component carries one, e.g.
+// "github.com/pkg/errors@v0.9.1/sub" becomes "github.com/pkg/errors/sub",
+// so a module-cache entry produces an importable path instead of a literal
+// "@version" segment.
+func stripModuleVersion(importPath string) string {
+	components := strings.Split(importPath, "/")
+	for i, component := range components {
+		if at := strings.Index(component, "@"); at >= 0 {
+			components[i] = component[:at]
+		}
+	}
+	return strings.Join(components, "/")
+}
+
+// cachedExportedNamesInDir is exportedNamesInDir, memoized on dir's
+// FileIdentity: unlike a package index directory (which is only ever
+// re-indexed after a mtime change we've already noticed), disambiguation can
+// call exportedNamesInDir on the same handful of candidate directories many
+// times within a single Run, so it's worth keying the cache on content
+// rather than re-parsing every call.
+func cachedExportedNamesInDir(dir string) (map[string]bool, error) {
+	identity, err := dirIdentity(dir)
+	if err != nil {
+		// Can't establish an identity for dir (e.g. it vanished); fall back
+		// to parsing it directly rather than caching a failure.
+		return exportedNamesInDir(dir)
+	}
+	if cached, ok := globalExportsCache.Get(identity); ok {
+		return cached.(map[string]bool), nil
+	}
+	names, err := exportedNamesInDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	globalExportsCache.Put(identity, names)
+	return names, nil
+}
+
+// dirIdentity derives a FileIdentity for dir out of the identities of its
+// non-test .go files, so it changes exactly when exportedNamesInDir's result
+// could change: a file being added, removed, or edited.
+func dirIdentity(dir string) (FileIdentity, error) {
+	entries, err := diskFS.ReadDir(dir)
+	if err != nil {
+		return FileIdentity{}, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".go") && nonTestGoFile(entry) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		fileIdentity, err := diskFS.Identity(filepath.Join(dir, name))
+		if err != nil {
+			return FileIdentity{}, err
+		}
+		hash.Write([]byte(name))
+		hash.Write(fileIdentity.Hash[:])
+	}
+
+	var sum [32]byte
+	copy(sum[:], hash.Sum(nil))
+	return FileIdentity{URI: dir, Hash: sum}, nil
+}
+
+// exportedNamesInDir returns the set of exported top-level identifiers
+// (funcs, types, vars, and consts) declared by the package in dir, used to
+// disambiguate candidates that share a base name.
+func exportedNamesInDir(dir string) (map[string]bool, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nonTestGoFile, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				collectExportedNames(decl, names)
+			}
+		}
+	}
+	return names, nil
+}
+
+func nonTestGoFile(info os.FileInfo) bool {
+	return !strings.HasSuffix(info.Name(), "_test.go")
+}
+
+func collectExportedNames(decl ast.Decl, names map[string]bool) {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil && d.Name.IsExported() {
+			names[d.Name.Name] = true
+		}
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.ValueSpec:
+				for _, name := range s.Names {
+					if name.IsExported() {
+						names[name.Name] = true
+					}
+				}
+			case *ast.TypeSpec:
+				if s.Name.IsExported() {
+					names[s.Name.Name] = true
+				}
+			}
+		}
+	}
+}